@@ -22,8 +22,20 @@ import (
 	"sync"
 
 	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/keyspan"
 )
 
+// clampInt constrains v to the closed interval [lo, hi].
+func clampInt(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
 type splice struct {
 	prev *node
 	next *node
@@ -37,12 +49,45 @@ func (s *splice) init(prev, next *node) {
 // Iterator is an iterator over the skiplist object. Use Skiplist.NewIter
 // to construct an iterator. The current state of the iterator can be cloned by
 // simply value copying the struct. All iterator methods are thread-safe.
+//
+// The one exception is rangeDelIter/span: once SetRangeDelIter has attached
+// a keyspan.FragmentIterator, that fragment iterator is a stateful, seekable
+// cursor owned by the caller, not a value that `clone := *it` deep-copies.
+// Two Iterators produced by copying a struct with a range-del iterator
+// attached alias the same underlying keyspan.FragmentIterator: repositioning
+// one corrupts the other's tombstone lookups, and using both from different
+// goroutines is a data race on that shared cursor. Callers that need to
+// clone an Iterator with range-del filtering must give each clone its own
+// keyspan.FragmentIterator (e.g. re-call SetRangeDelIter with a fresh
+// iterator over the same fragments) rather than relying on a struct copy.
 type Iterator struct {
 	list  *Skiplist
 	nd    *node
 	kv    base.InternalKV
 	lower []byte
 	upper []byte
+	// hasSnapshot is true for an iterator returned by Skiplist.NewSnapshotIter
+	// and false for one returned by Skiplist.NewIter. It's tracked separately
+	// from visibleSeqNum because 0 is itself a valid sequence number to
+	// snapshot at (e.g. a snapshot taken before any key was ever committed,
+	// which should see nothing) and so can't double as an "unset" sentinel.
+	hasSnapshot bool
+	// visibleSeqNum, when hasSnapshot is true, scopes the iterator to a
+	// snapshot: nodes whose keyTrailer sequence number is greater than
+	// visibleSeqNum are skipped over as though they did not exist.
+	visibleSeqNum uint64
+	// rangeDelIter, if set via SetRangeDelIter, is consulted by the
+	// positioning methods to skip over point keys shadowed by an overlapping
+	// range tombstone with a higher sequence number, without the caller
+	// needing to layer a merging iterator on top of the memtable to do so.
+	rangeDelIter keyspan.FragmentIterator
+	// span caches the most recently fetched rangeDelIter fragment so that a
+	// run of keys within the same tombstone doesn't reseek it per key.
+	span *keyspan.Span
+	// err records the first error returned by rangeDelIter, surfaced via
+	// Error(). Once set, positioning methods stop consulting rangeDelIter
+	// rather than silently treating the failed lookup as "not covered".
+	err error
 }
 
 // Iterator implements the base.InternalIterator interface.
@@ -54,12 +99,49 @@ var iterPool = sync.Pool{
 	},
 }
 
+// NewSnapshotIter returns a new Iterator over the skiplist, scoped to the
+// given sequence number: keys committed after seqNum are treated as though
+// they do not exist. This lets a long-running read transaction iterate over
+// the memtable in isolation, without the caller having to stitch a
+// MergingIter on top of the memtable purely to filter out newer versions.
+func (s *Skiplist) NewSnapshotIter(seqNum uint64, lower, upper []byte) *Iterator {
+	it := iterPool.Get().(*Iterator)
+	*it = Iterator{list: s, lower: lower, upper: upper, hasSnapshot: true, visibleSeqNum: seqNum}
+	return it
+}
+
+// SetRangeDelIter attaches a fragment iterator over the range tombstones
+// that overlap this memtable, so that Next, Prev, SeekGE, and SeekLT skip
+// point keys shadowed by a tombstone with a higher sequence number. Pass nil
+// to detach.
+//
+// rangeDelIter stays owned by the caller but is driven by this Iterator
+// from then on: it must not be shared with, or concurrently driven by, any
+// other Iterator. Close drops the reference without closing it. In
+// particular, cloning this Iterator by value-copying the struct does not
+// give the clone an independent cursor — both copies would seek the same
+// underlying rangeDelIter out from under each other. A clone that needs
+// range-del filtering must call SetRangeDelIter again with its own fragment
+// iterator over the same tombstones.
+func (it *Iterator) SetRangeDelIter(rangeDelIter keyspan.FragmentIterator) {
+	it.rangeDelIter = rangeDelIter
+	it.span = nil
+	if it.rangeDelIter != nil {
+		it.rangeDelIter.SetBounds(it.lower, it.upper)
+	}
+}
+
 // Close resets the iterator.
 func (it *Iterator) Close() error {
 	it.list = nil
 	it.nd = nil
 	it.lower = nil
 	it.upper = nil
+	it.hasSnapshot = false
+	it.visibleSeqNum = 0
+	it.rangeDelIter = nil
+	it.span = nil
+	it.err = nil
 	iterPool.Put(it)
 	return nil
 }
@@ -70,7 +152,7 @@ func (it *Iterator) String() string {
 
 // Error returns any accumulated error.
 func (it *Iterator) Error() error {
-	return nil
+	return it.err
 }
 
 // SeekGE moves the iterator to the first entry whose key is greater than or
@@ -85,13 +167,29 @@ func (it *Iterator) SeekGE(key []byte, flags base.SeekGEFlags) *base.InternalKV
 			return nil
 		}
 		less := it.list.cmp(it.kv.K.UserKey, key) < 0
-		// Arbitrary constant. By measuring the seek cost as a function of the
-		// number of elements in the skip list, and fitting to a model, we
-		// could adjust the number of nexts based on the current size of the
-		// skip list.
-		const numNexts = 5
+		// Bound the number of Next calls we're willing to try based on the
+		// height of the skiplist: a short memtable is cheap to walk
+		// linearly, while a tall one should fall back to the O(log n)
+		// splice search sooner, since a chain of Nexts through a tall list
+		// is evidence that the target is far away.
+		//
+		// An earlier version of this loop also tried to short-circuit by
+		// peeking one level up via it.list.getNext(it.nd, 1): if that
+		// level-1 successor was still less than key, it bailed out to the
+		// splice search immediately. That's unsafe: a skiplist node's tower
+		// is only allocated up to its own randomly chosen height, so
+		// getNext(nd, 1) on a height-1 node (roughly half of all nodes)
+		// reads a tower slot that was never allocated for it. It was
+		// dropped in favor of relying solely on maxNexts.
+		//
+		// Each Next() call below runs skipForward, so one Next may pass many
+		// nodes: a run shadowed by a range tombstone is crossed with one
+		// splice search, while nodes hidden by the snapshot are stepped over
+		// one at a time. maxNexts bounds the number of Next calls, not the
+		// number of nodes passed.
+		maxNexts := clampInt(64>>(it.list.Height()/2), 4, 64)
 		kv := &it.kv
-		for i := 0; less && i < numNexts; i++ {
+		for i := 0; less && i < maxNexts; i++ {
 			if kv = it.Next(); kv == nil {
 				// Iterator is done.
 				return nil
@@ -103,6 +201,7 @@ func (it *Iterator) SeekGE(key []byte, flags base.SeekGEFlags) *base.InternalKV
 		}
 	}
 	_, it.nd, _ = it.seekForBaseSplice(key)
+	it.skipForward()
 	if it.nd == it.list.tail {
 		return nil
 	}
@@ -131,6 +230,9 @@ func (it *Iterator) SeekLT(key []byte, flags base.SeekLTFlags) *base.InternalKV
 	// NB: the top-level Iterator has already adjusted key based on
 	// the upper-bound.
 	it.nd, _, _ = it.seekForBaseSplice(key)
+	for it.nd != it.list.head && it.skip(it.nd) {
+		it.nd = it.list.getPrev(it.nd, 0)
+	}
 	if it.nd == it.list.head {
 		return nil
 	}
@@ -149,6 +251,7 @@ func (it *Iterator) SeekLT(key []byte, flags base.SeekLTFlags) *base.InternalKV
 // that key is greater than or equal to the lower bound (e.g. via a call to SeekGE(lower)).
 func (it *Iterator) First() *base.InternalKV {
 	it.nd = it.list.getNext(it.list.head, 0)
+	it.skipForward()
 	if it.nd == it.list.tail {
 		return nil
 	}
@@ -167,6 +270,9 @@ func (it *Iterator) First() *base.InternalKV {
 // key is less than the upper bound (e.g. via a call to SeekLT(upper)).
 func (it *Iterator) Last() *base.InternalKV {
 	it.nd = it.list.getPrev(it.list.tail, 0)
+	for it.nd != it.list.head && it.skip(it.nd) {
+		it.nd = it.list.getPrev(it.nd, 0)
+	}
 	if it.nd == it.list.head {
 		return nil
 	}
@@ -185,6 +291,7 @@ func (it *Iterator) Last() *base.InternalKV {
 // due to performance. Keep the two in sync.
 func (it *Iterator) Next() *base.InternalKV {
 	it.nd = it.list.getNext(it.nd, 0)
+	it.skipForward()
 	if it.nd == it.list.tail {
 		return nil
 	}
@@ -199,7 +306,9 @@ func (it *Iterator) Next() *base.InternalKV {
 
 // NextPrefix advances to the next position with a new prefix. Returns the key
 // and value if the iterator is pointing at a valid entry, and (nil, nil)
-// otherwise.
+// otherwise. If a range deletion set via SetRangeDelIter shadows the
+// remainder of the current prefix, SeekGE jumps directly to the tombstone's
+// end key rather than stepping through the shadowed keys one at a time.
 func (it *Iterator) NextPrefix(succKey []byte) *base.InternalKV {
 	return it.SeekGE(succKey, base.SeekGEFlagsNone.EnableTrySeekUsingNext())
 }
@@ -208,6 +317,9 @@ func (it *Iterator) NextPrefix(succKey []byte) *base.InternalKV {
 // iterator is pointing at a valid entry, and (nil, nil) otherwise.
 func (it *Iterator) Prev() *base.InternalKV {
 	it.nd = it.list.getPrev(it.nd, 0)
+	for it.nd != it.list.head && it.skip(it.nd) {
+		it.nd = it.list.getPrev(it.nd, 0)
+	}
 	if it.nd == it.list.head {
 		return nil
 	}
@@ -225,6 +337,99 @@ func (it *Iterator) value() []byte {
 	return it.nd.getValue(it.list.arena)
 }
 
+// visible returns true if nd should be observable by this iterator. It is
+// always true for a plain (non-snapshot-scoped) iterator; for an iterator
+// returned by Skiplist.NewSnapshotIter, it is true only if nd's sequence
+// number does not postdate the snapshot.
+func (it *Iterator) visible(nd *node) bool {
+	return !it.hasSnapshot || uint64(nd.keyTrailer.SeqNum()) <= it.visibleSeqNum
+}
+
+// skip returns true if nd should be skipped over by the positioning
+// methods: either it postdates the iterator's snapshot, or it falls within
+// a range tombstone with a higher sequence number.
+func (it *Iterator) skip(nd *node) bool {
+	if !it.visible(nd) {
+		return true
+	}
+	if it.rangeDelIter == nil || it.err != nil {
+		return false
+	}
+	userKey := it.list.arena.getBytes(nd.keyOffset, nd.keySize)
+	return it.coveredByRangeDel(userKey, nd.keyTrailer.SeqNum())
+}
+
+// skipForward advances it.nd forward past any run of nodes that should be
+// skipped, stopping at the tail or at the next node that's visible and
+// uncovered. Unlike repeatedly testing skip and calling getNext(nd, 0),
+// skipForward recognizes when an entire remainder of a range tombstone's
+// span is shadowed and jumps directly to the tombstone's end key via
+// seekForBaseSplice, rather than stepping through every covered node one at
+// a time. This is what lets First, Next, and SeekGE's TrySeekUsingNext fast
+// path (and so NextPrefix, which is built on it) stay cheap over a long run
+// shadowed by a single tombstone instead of degrading to O(run length).
+func (it *Iterator) skipForward() {
+	for it.nd != it.list.tail {
+		if it.visible(it.nd) {
+			if it.rangeDelIter == nil || it.err != nil {
+				return
+			}
+			userKey := it.list.arena.getBytes(it.nd.keyOffset, it.nd.keySize)
+			if !it.coveredByRangeDel(userKey, it.nd.keyTrailer.SeqNum()) {
+				return
+			}
+			_, it.nd, _ = it.seekForBaseSplice(it.span.End)
+			continue
+		}
+		it.nd = it.list.getNext(it.nd, 0)
+	}
+}
+
+// coveredByRangeDel repositions it.rangeDelIter as needed and reports
+// whether userKey, at the given sequence number, falls within a tombstone
+// with a higher sequence number. If the iterator is snapshot-scoped (see
+// Skiplist.NewSnapshotIter), a tombstone that itself postdates the snapshot
+// is ignored: otherwise a range deletion committed after the snapshot was
+// taken could hide a point key that the snapshot is supposed to still see,
+// which would be a snapshot-isolation violation.
+//
+// If rangeDelIter itself errors, the error is recorded in it.err (surfaced
+// via Error()) rather than silently treated as "not covered": a caller that
+// only checks the returned *base.InternalKV and never calls Error() would
+// otherwise have no way to learn that tombstone filtering may have failed.
+func (it *Iterator) coveredByRangeDel(userKey []byte, seqNum base.SeqNum) bool {
+	// Fragments returned by rangeDelIter are non-overlapping and sorted by
+	// start key, so the span (if any) that contains userKey is the one
+	// SeekGE lands on.
+	if it.span == nil || !it.span.Contains(it.list.cmp, userKey) {
+		var err error
+		it.span, err = it.rangeDelIter.SeekGE(userKey)
+		if err != nil {
+			it.span = nil
+			it.err = err
+			return false
+		}
+	}
+	if it.span == nil || !it.span.Contains(it.list.cmp, userKey) {
+		return false
+	}
+	for _, k := range it.span.Keys {
+		tombstoneSeqNum := k.SeqNum()
+		if tombstoneSeqNum <= seqNum {
+			// This tombstone predates (or is concurrent with) userKey, so
+			// it cannot be the one that deleted it.
+			continue
+		}
+		if it.hasSnapshot && uint64(tombstoneSeqNum) > it.visibleSeqNum {
+			// The tombstone itself isn't visible at this snapshot, so it
+			// must not shadow a key the snapshot can otherwise see.
+			continue
+		}
+		return true
+	}
+	return false
+}
+
 // Head true iff the iterator is positioned at the sentinel head node.
 func (it *Iterator) Head() bool {
 	return it.nd == it.list.head
@@ -241,6 +446,10 @@ func (it *Iterator) Tail() bool {
 func (it *Iterator) SetBounds(lower, upper []byte) {
 	it.lower = lower
 	it.upper = upper
+	if it.rangeDelIter != nil {
+		it.rangeDelIter.SetBounds(lower, upper)
+		it.span = nil
+	}
 }
 
 // SetContext implements base.InternalIterator.
@@ -0,0 +1,265 @@
+// Copyright 2020 The LevelDB-Go and Pebble Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package arenaskl
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/internal/base"
+	"github.com/cockroachdb/pebble/internal/keyspan"
+)
+
+// TestSnapshotIterCollapsesSupersededVersions verifies that a run of
+// versions of the same user key newer than the snapshot's sequence number
+// collapses to a single visible position, rather than surfacing as repeated
+// "invisible" stops that the caller would otherwise have to skip itself.
+func TestSnapshotIterCollapsesSupersededVersions(t *testing.T) {
+	arena := NewArena(1 << 20)
+	skl := NewSkiplist(arena, base.DefaultComparer.Compare)
+
+	add := func(key string, seqNum uint64) {
+		ikey := base.InternalKey{
+			UserKey: []byte(key),
+			Trailer: base.MakeTrailer(seqNum, base.InternalKeyKindSet),
+		}
+		if err := skl.Add(ikey, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Three versions of "a" postdating the snapshot, one at the snapshot,
+	// and a single version of "b" also at the snapshot.
+	add("a", 5)
+	add("a", 4)
+	add("a", 3)
+	add("a", 2)
+	add("b", 2)
+
+	it := skl.NewSnapshotIter(2, nil, nil)
+	defer it.Close()
+
+	kv := it.First()
+	if kv == nil || string(kv.K.UserKey) != "a" || kv.K.SeqNum() != 2 {
+		t.Fatalf("First: got %v, want key=a seqNum=2", kv)
+	}
+	kv = it.Next()
+	if kv == nil || string(kv.K.UserKey) != "b" {
+		t.Fatalf("Next: got %v, want key=b (not a repeated, invisible \"a\")", kv)
+	}
+	if kv := it.Next(); kv != nil {
+		t.Fatalf("Next: got %v, want nil", kv)
+	}
+}
+
+// TestSnapshotIterAtSeqNumZeroSeesNothing verifies that a snapshot taken at
+// sequence number 0 -- before any key was ever committed -- sees no keys,
+// rather than being confused with an unfiltered (non-snapshot) iterator. 0
+// is a valid sequence number to snapshot at, not a sentinel for "unset".
+func TestSnapshotIterAtSeqNumZeroSeesNothing(t *testing.T) {
+	arena := NewArena(1 << 20)
+	skl := NewSkiplist(arena, base.DefaultComparer.Compare)
+
+	ikey := base.InternalKey{
+		UserKey: []byte("a"),
+		Trailer: base.MakeTrailer(1, base.InternalKeyKindSet),
+	}
+	if err := skl.Add(ikey, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	it := skl.NewSnapshotIter(0, nil, nil)
+	defer it.Close()
+
+	if kv := it.First(); kv != nil {
+		t.Fatalf("First: got %v, want nil (snapshot at seqNum 0 predates every key)", kv)
+	}
+}
+
+// TestIteratorSeekGEJumpsPastRangeDelShadowedRun verifies that SeekGE (and
+// so NextPrefix, which is implemented in terms of it) passes over every key
+// shadowed by a covering tombstone and lands on the first key at or after
+// the tombstone's end key. It checks only where the iterator lands; the cost
+// of the jump is checked by TestIteratorNextPrefixJumpsPastLargeShadowedRun.
+func TestIteratorSeekGEJumpsPastRangeDelShadowedRun(t *testing.T) {
+	arena := NewArena(1 << 20)
+	skl := NewSkiplist(arena, base.DefaultComparer.Compare)
+
+	add := func(key string, seqNum uint64) {
+		ikey := base.InternalKey{
+			UserKey: []byte(key),
+			Trailer: base.MakeTrailer(seqNum, base.InternalKeyKindSet),
+		}
+		if err := skl.Add(ikey, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	add("a", 1)
+	add("b", 1)
+	add("c", 1)
+	add("d", 1)
+
+	// A single tombstone [a, d) at seqNum 5 shadows a, b, and c.
+	rangeDelIter := keyspan.NewIter(base.DefaultComparer.Compare, []keyspan.Span{
+		{
+			Start: []byte("a"),
+			End:   []byte("d"),
+			Keys: []keyspan.Key{
+				{Trailer: base.MakeTrailer(5, base.InternalKeyKindRangeDelete)},
+			},
+		},
+	})
+
+	it := skl.NewIter(nil, nil)
+	defer it.Close()
+	it.SetRangeDelIter(rangeDelIter)
+
+	kv := it.SeekGE([]byte("a"), base.SeekGEFlagsNone)
+	if kv == nil || string(kv.K.UserKey) != "d" {
+		t.Fatalf("SeekGE: got %v, want key=d (jumped over shadowed a, b, c)", kv)
+	}
+}
+
+// TestIteratorNextPrefixJumpsPastLargeShadowedRun is a regression test for a
+// bug where the jump-to-span.End optimization was only wired into SeekGE's
+// manual seekForBaseSplice fallback, never into Next's skip-gated stepping
+// loop. Since NextPrefix always calls SeekGE with TrySeekUsingNext set, and
+// the fast path there repeatedly calls it.Next(), a single NextPrefix call
+// over a prefix shadowed by one large tombstone used to cost O(run length)
+// instead of the promised O(log n): each it.Next() call stepped through the
+// shadowed run one node at a time. This builds a run large enough that a
+// linear scan would be clearly observable in elapsed time, and asserts the
+// call still completes quickly.
+func TestIteratorNextPrefixJumpsPastLargeShadowedRun(t *testing.T) {
+	const runLen = 50_000
+	arena := NewArena(32 << 20)
+	skl := NewSkiplist(arena, base.DefaultComparer.Compare)
+
+	add := func(key string, seqNum uint64) {
+		ikey := base.InternalKey{
+			UserKey: []byte(key),
+			Trailer: base.MakeTrailer(seqNum, base.InternalKeyKindSet),
+		}
+		if err := skl.Add(ikey, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("0", 1)
+	for i := 0; i < runLen; i++ {
+		add(fmt.Sprintf("1%08d", i), 1)
+	}
+	add("2", 1)
+
+	// A single tombstone [1, 2) at seqNum 5 shadows every "1%08d" key.
+	rangeDelIter := keyspan.NewIter(base.DefaultComparer.Compare, []keyspan.Span{
+		{
+			Start: []byte("1"),
+			End:   []byte("2"),
+			Keys: []keyspan.Key{
+				{Trailer: base.MakeTrailer(5, base.InternalKeyKindRangeDelete)},
+			},
+		},
+	})
+
+	it := skl.NewIter(nil, nil)
+	defer it.Close()
+	it.SetRangeDelIter(rangeDelIter)
+
+	kv := it.SeekGE([]byte("0"), base.SeekGEFlagsNone)
+	if kv == nil || string(kv.K.UserKey) != "0" {
+		t.Fatalf("SeekGE: got %v, want key=0", kv)
+	}
+
+	start := time.Now()
+	kv = it.NextPrefix([]byte("1"))
+	elapsed := time.Since(start)
+
+	if kv == nil || string(kv.K.UserKey) != "2" {
+		t.Fatalf("NextPrefix: got %v, want key=2 (jumped over the %d shadowed keys)", kv, runLen)
+	}
+	// A jump via seekForBaseSplice is O(log n); a linear scan over runLen
+	// shadowed nodes would not complete anywhere near this quickly.
+	const budget = 50 * time.Millisecond
+	if elapsed > budget {
+		t.Fatalf("NextPrefix took %s for a %d-key shadowed run, want under %s; "+
+			"this suggests it stepped through the run instead of jumping to the tombstone's end",
+			elapsed, runLen, budget)
+	}
+}
+
+func buildBenchSkiplist(b *testing.B, numKeys int) *Skiplist {
+	arena := NewArena(uint32(numKeys) * 256)
+	skl := NewSkiplist(arena, base.DefaultComparer.Compare)
+	for i := 0; i < numKeys; i++ {
+		key := base.InternalKey{
+			UserKey: []byte(fmt.Sprintf("%08d", i)),
+			Trailer: base.MakeTrailer(uint64(i+1), base.InternalKeyKindSet),
+		}
+		if err := skl.Add(key, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return skl
+}
+
+// BenchmarkSeekGEScanHeavy seeks to keys in ascending order with
+// TrySeekUsingNext set: each pass over the keyspace starts from First, and
+// after its first seek each target is the key right after the iterator's
+// current position -- the workload the
+// adaptive maxNexts bound in SeekGE is meant to keep fast for small
+// skiplists by leaning on Next chains instead of the splice search.
+func BenchmarkSeekGEScanHeavy(b *testing.B) {
+	for _, numKeys := range []int{10_000, 1_000_000} {
+		b.Run(fmt.Sprintf("keys=%d", numKeys), func(b *testing.B) {
+			skl := buildBenchSkiplist(b, numKeys)
+			it := skl.NewIter(nil, nil)
+			defer it.Close()
+			it.First()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pos := i % (numKeys - 8)
+				if pos == 0 {
+					it.First()
+				}
+				target := []byte(fmt.Sprintf("%08d", pos+4))
+				it.SeekGE(target, base.SeekGEFlagsNone.EnableTrySeekUsingNext())
+			}
+		})
+	}
+}
+
+// BenchmarkSeekGEPointLookupHeavy seeks to uniformly random keys across the
+// whole keyspace -- the workload that should fall back to the O(log n)
+// splice search rather than walking a long Next chain, which is why
+// maxNexts shrinks as the skiplist (and thus its height) grows.
+func BenchmarkSeekGEPointLookupHeavy(b *testing.B) {
+	for _, numKeys := range []int{10_000, 1_000_000} {
+		b.Run(fmt.Sprintf("keys=%d", numKeys), func(b *testing.B) {
+			skl := buildBenchSkiplist(b, numKeys)
+			it := skl.NewIter(nil, nil)
+			defer it.Close()
+			rng := rand.New(rand.NewSource(0))
+			// last is the index of the key the iterator is positioned at;
+			// numKeys means it is not positioned yet.
+			last := numKeys
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				n := rng.Intn(numKeys)
+				target := []byte(fmt.Sprintf("%08d", n))
+				// TrySeekUsingNext is only valid for a target at or after
+				// the iterator's current position.
+				flags := base.SeekGEFlagsNone
+				if n >= last {
+					flags = flags.EnableTrySeekUsingNext()
+				}
+				it.SeekGE(target, flags)
+				last = n
+			}
+		})
+	}
+}